@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Resolver resolves an IP address to a hostname, the same contract
+// net.LookupAddr exposes but narrowed to a single result so dnsCache and its
+// callers don't have to think about multiple PTR records.
+type Resolver interface {
+	LookupAddr(ip string) (string, error)
+}
+
+// systemResolver is the default Resolver, backed by the system's resolver.
+type systemResolver struct{}
+
+func (systemResolver) LookupAddr(ip string) (string, error) {
+	names, err := net.LookupAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	if len(names) < 1 {
+		return "", errors.New("no PTR record for " + ip)
+	}
+	return strings.TrimRight(names[0], "."), nil
+}
+
+// hostsFileResolver serves names from a static /etc/hosts-style map, falling
+// back to another Resolver for anything it doesn't know about. Useful in
+// VPCs where reverse-DNS isn't available for cluster nodes.
+type hostsFileResolver struct {
+	hosts    map[string]string
+	fallback Resolver
+}
+
+// NewHostsFileResolver parses an /etc/hosts-style file ("ip hostname ...",
+// blank lines and "#" comments ignored) into a hostsFileResolver.
+func NewHostsFileResolver(filename string, fallback Resolver) (*hostsFileResolver, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		hosts[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &hostsFileResolver{hosts: hosts, fallback: fallback}, nil
+}
+
+func (h *hostsFileResolver) LookupAddr(ip string) (string, error) {
+	if name, ok := h.hosts[ip]; ok {
+		return name, nil
+	}
+	if h.fallback != nil {
+		return h.fallback.LookupAddr(ip)
+	}
+	return "", errors.New("no entry for " + ip + " in hosts file")
+}
+
+type dnsCacheEntry struct {
+	name    string
+	err     error
+	expires time.Time
+}
+
+// dnsCache memoizes Resolver lookups for ttl. The events loop can call
+// LookupAddr thousands of times per session against a handful of distinct
+// node IPs, so caching (even failed lookups, to avoid re-querying dead PTR
+// records every row) matters far more than it would for a one-shot tool.
+type dnsCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	entries  map[string]dnsCacheEntry
+	resolver Resolver
+}
+
+func NewDnsCache(resolver Resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:      ttl,
+		entries:  make(map[string]dnsCacheEntry),
+		resolver: resolver,
+	}
+}
+
+// Seed installs a known name for ip without consulting the resolver. (The
+// system.peers/system.local pre-seeding in SeedFromCluster goes through
+// Lookup instead, since those tables carry IPs but no hostnames.)
+func (c *dnsCache) Seed(ip, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[ip] = dnsCacheEntry{name: name, expires: time.Now().Add(c.ttl)}
+}
+
+// Lookup returns the cached name for ip, falling back to the resolver (and
+// caching whatever it returns, including an error) on a miss or an expired
+// entry.
+func (c *dnsCache) Lookup(ip string) (string, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[ip]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.name, e.err
+	}
+	c.mu.Unlock()
+
+	name, err := c.resolver.LookupAddr(ip)
+
+	c.mu.Lock()
+	c.entries[ip] = dnsCacheEntry{name: name, err: err, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return name, err
+}
+
+// SeedFromCluster resolves every node in the cluster (system.local plus
+// system.peers) once up front, so the events loop in FetchEvents rarely needs to
+// make its own resolver call.
+func SeedFromCluster(client *gocql.Session, cache *dnsCache) error {
+	var addrs []net.IP
+
+	var local net.IP
+	if err := client.Query("SELECT broadcast_address FROM system.local").Scan(&local); err != nil {
+		return err
+	}
+	addrs = append(addrs, local)
+
+	iter := client.Query("SELECT peer FROM system.peers").Iter()
+	var peer net.IP
+	for iter.Scan(&peer) {
+		addrs = append(addrs, peer)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, ip := range addrs {
+		cache.Lookup(ip.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// unresolvedIP matches an IPv4 address embedded in an activity string, e.g.
+// "Sending message to /10.0.0.12". Achtung; this is IPv4-specific!
+var unresolvedIP = regexp.MustCompile(` (?P<IP>/[\d]{1,3}\.[\d]{1,3}\.[\d]{1,3}\.[\d]{1,3})`)
+
+// BuildResolver assembles the Resolver chain for --hosts-file (if set) over
+// the system resolver, and pre-seeds a dnsCache from the cluster's own node
+// list so the events loop rarely needs to make its own DNS call.
+func BuildResolver(client *gocql.Session, hostsFile string, ttl time.Duration) (*dnsCache, error) {
+	var resolver Resolver = systemResolver{}
+	if len(hostsFile) > 0 {
+		r, err := NewHostsFileResolver(hostsFile, resolver)
+		if err != nil {
+			return nil, err
+		}
+		resolver = r
+	}
+
+	cache := NewDnsCache(resolver, ttl)
+	if err := SeedFromCluster(client, cache); err != nil {
+		log.Printf("warning: could not pre-seed DNS cache from system.peers/system.local: %s", err)
+	}
+
+	return cache, nil
+}
+
+// FetchEvents retrieves and resolves every event for a session, optionally
+// filtered to a single source name/IP. It's shared by the `events` command
+// and `watch --drill`.
+func FetchEvents(client *gocql.Session, sessionId, onlySource string, cache *dnsCache) ([]Event, error) {
+	var id time.Time
+	var activity string
+	var srcHost net.IP
+	var srcElapsed int
+	var thread string
+
+	rows := make([]Event, 0)
+
+	iter := client.Query(`SELECT dateOf(event_id),activity,source,source_elapsed,thread FROM system_traces.events WHERE session_id = ?`, sessionId).Iter()
+	for iter.Scan(&id, &activity, &srcHost, &srcElapsed, &thread) {
+		var srcName string
+		// Resolve IPs to hostnames (if possible)
+		if name, err := cache.Lookup(srcHost.String()); err != nil {
+			srcName = srcHost.String()
+		} else {
+			srcName = name
+		}
+
+		// Look for unresolved IP address in the activity string and attempt to resolve it, noting the
+		// mentioned host so span export can reconstruct cross-node parent/child relationships.
+		var mentions string
+		if m := matches(unresolvedIP, activity); len(m) > 0 {
+			ip := strings.TrimLeft(m["IP"], "/")
+			// Best-effort
+			if name, err := cache.Lookup(ip); err == nil {
+				mentions = name
+				activity = strings.Replace(activity, m["IP"], name, -1)
+			}
+		}
+
+		// (Maybe )filter events to those from a single source name/IP.
+		if len(onlySource) < 1 || onlySource == srcName {
+			rows = append(rows, Event{id, activity, srcName, srcElapsed, thread, mentions})
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is implemented by the typed rows each subcommand produces, so a
+// single Renderer can turn any of them into table/json/csv/tsv output.
+type Record interface {
+	Header() []string
+	Row() []string
+}
+
+// Renderer writes a stream of records to stdout in some wire format.
+type Renderer interface {
+	WriteHeader(columns []string) error
+	WriteRow(columns []string) error
+	Close() error
+}
+
+// NewRenderer builds the Renderer for --output. yellowCol/cyanCol colorize
+// the given column index in table output (pass -1 to leave a column plain);
+// they're ignored by the other formats.
+func NewRenderer(format string, yellowCol, cyanCol int) (Renderer, error) {
+	switch format {
+	case "", "table":
+		return newTableRenderer(os.Stdout, yellowCol, cyanCol), nil
+	case "json":
+		return newJSONRenderer(os.Stdout), nil
+	case "csv":
+		return newDelimitedRenderer(os.Stdout, ','), nil
+	case "tsv":
+		return newDelimitedRenderer(os.Stdout, '\t'), nil
+	}
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+// tableGap is the minimum number of plain spaces left between columns.
+const tableGap = 2
+
+// tableRenderer is the original colorized, column-aligned output. Rows are
+// buffered so column widths can be computed from the plain cell values up
+// front; padding is added to those widths and color is wrapped around only
+// the content, never the padding, so ANSI escapes never affect alignment.
+type tableRenderer struct {
+	out                io.Writer
+	yellowCol, cyanCol int
+	header             []string
+	headerWritten      bool
+	rows               [][]string
+}
+
+func newTableRenderer(out io.Writer, yellowCol, cyanCol int) *tableRenderer {
+	return &tableRenderer{out: out, yellowCol: yellowCol, cyanCol: cyanCol}
+}
+
+func (t *tableRenderer) WriteHeader(columns []string) error {
+	t.header = columns
+	return nil
+}
+
+func (t *tableRenderer) WriteRow(columns []string) error {
+	t.rows = append(t.rows, append([]string(nil), columns...))
+	return nil
+}
+
+// Close renders and flushes everything buffered since the last Close, then
+// clears the row buffer so Watch can call it after each new session without
+// reprinting earlier rows. Column widths are computed per Close, from the
+// header and the rows buffered since the previous Close.
+func (t *tableRenderer) Close() error {
+	if len(t.rows) == 0 && (t.headerWritten || len(t.header) == 0) {
+		return nil
+	}
+
+	widths := make([]int, len(t.header))
+	for i, h := range t.header {
+		widths[i] = len(h)
+	}
+	for _, row := range t.rows {
+		for i, v := range row {
+			if i < len(widths) && len(v) > widths[i] {
+				widths[i] = len(v)
+			}
+		}
+	}
+
+	if !t.headerWritten && len(t.header) > 0 {
+		if err := t.writeRow(t.header, widths, -1, -1); err != nil {
+			return err
+		}
+		t.headerWritten = true
+	}
+	for _, row := range t.rows {
+		if err := t.writeRow(row, widths, t.yellowCol, t.cyanCol); err != nil {
+			return err
+		}
+	}
+
+	t.rows = nil
+	return nil
+}
+
+// writeRow pads each cell (other than the last) out to its column's width
+// plus tableGap, then colorizes the yellowCol/cyanCol cell's content. Since
+// padding is computed from the plain value and appended after colorizing,
+// the escape bytes never factor into alignment.
+func (t *tableRenderer) writeRow(row []string, widths []int, yellowCol, cyanCol int) error {
+	var b strings.Builder
+	for i, v := range row {
+		content := v
+		switch i {
+		case yellowCol:
+			content = yellow(v)
+		case cyanCol:
+			content = cyan(v)
+		}
+		b.WriteString(content)
+
+		if i < len(row)-1 {
+			pad := 0
+			if i < len(widths) {
+				pad = widths[i] - len(v)
+			}
+			if pad < 0 {
+				pad = 0
+			}
+			b.WriteString(strings.Repeat(" ", pad+tableGap))
+		}
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(t.out, b.String())
+	return err
+}
+
+// jsonRenderer writes one JSON object per row (NDJSON), so large dumps can
+// stream into jq or similar without buffering the whole trace in memory.
+type jsonRenderer struct {
+	enc    *json.Encoder
+	header []string
+}
+
+func newJSONRenderer(out io.Writer) *jsonRenderer {
+	return &jsonRenderer{enc: json.NewEncoder(out)}
+}
+
+func (j *jsonRenderer) WriteHeader(columns []string) error {
+	j.header = columns
+	return nil
+}
+
+func (j *jsonRenderer) WriteRow(columns []string) error {
+	row := make(map[string]string, len(columns))
+	for i, v := range columns {
+		if i < len(j.header) {
+			row[j.header[i]] = v
+		}
+	}
+	return j.enc.Encode(row)
+}
+
+func (j *jsonRenderer) Close() error {
+	return nil
+}
+
+// delimitedRenderer backs both csv and tsv output; encoding/csv quotes any
+// field containing its delimiter, so activity strings with embedded commas
+// or tabs still round-trip correctly.
+type delimitedRenderer struct {
+	w *csv.Writer
+}
+
+func newDelimitedRenderer(out io.Writer, comma rune) *delimitedRenderer {
+	w := csv.NewWriter(out)
+	w.Comma = comma
+	return &delimitedRenderer{w: w}
+}
+
+func (d *delimitedRenderer) WriteHeader(columns []string) error {
+	return d.w.Write(columns)
+}
+
+func (d *delimitedRenderer) WriteRow(columns []string) error {
+	return d.w.Write(columns)
+}
+
+func (d *delimitedRenderer) Close() error {
+	d.w.Flush()
+	return d.w.Error()
+}
+
+func (s Session) Header() []string {
+	return []string{"session_id", "duration", "started_at", "query"}
+}
+
+func (s Session) Row() []string {
+	return []string{s.Id.String(), strconv.Itoa(s.Duration), s.StartedAt.Format(time.RFC3339Nano), s.Parameters["query"]}
+}
+
+func (e Event) Header() []string {
+	return []string{"timestamp", "source", "source_elapsed", "thread", "activity"}
+}
+
+func (e Event) Row() []string {
+	return []string{e.Id.Format(time.RFC3339Nano), e.Source, strconv.Itoa(e.SourceElapsed), e.Thread, e.Activity}
+}
+
+func (q QueryStat) Header() []string {
+	columns := append([]string(nil), statsGroupBy...)
+	return append(columns, "count", "min", "max", "p50", "p95", "p99")
+}
+
+func (q QueryStat) Row() []string {
+	var row []string
+	for _, d := range statsGroupBy {
+		switch d {
+		case "query":
+			row = append(row, q.Query)
+		case "coordinator":
+			row = append(row, q.Coordinator)
+		}
+	}
+	return append(row,
+		strconv.Itoa(q.count),
+		strconv.Itoa(q.min),
+		strconv.Itoa(q.max),
+		strconv.Itoa(q.percentile(0.50)),
+		strconv.Itoa(q.percentile(0.95)),
+		strconv.Itoa(q.percentile(0.99)),
+	)
+}
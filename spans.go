@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event is a single row from system_traces.events, with the source host
+// already resolved to a name where possible.
+type Event struct {
+	Id            time.Time
+	Activity      string
+	Source        string
+	SourceElapsed int
+	Thread        string
+	// Mentions is the resolved hostname of any other node referenced in
+	// Activity (e.g. a coordinator forwarding a request to a replica), if any.
+	Mentions string
+}
+
+// Span is this tool's lightweight stand-in for an OpenTelemetry span; it
+// carries just enough to render NDJSON or hand off to the otel SDK.
+type Span struct {
+	TraceID      trace.TraceID
+	SpanID       trace.SpanID
+	ParentSpanID trace.SpanID
+	Name         string
+	Source       string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]string
+}
+
+// spanKey identifies a (source, thread) pair, which is the closest thing
+// system_traces.events has to a single span of execution.
+type spanKey struct {
+	source, thread string
+}
+
+// BuildSpans reconstructs a trace for a session: one root span covering the
+// whole query, and one child span per event. Events sharing a (source,
+// thread) pair are treated as a sequential chain; an event whose activity
+// mentions another node is used to locate that node's first event and
+// reparent its chain underneath it, approximating cross-node causality.
+func BuildSpans(sessionId, command string, startedAt time.Time, duration int, events []Event) []Span {
+	traceId := traceIdFromSession(sessionId)
+	rootId := spanId(sessionId, "root")
+
+	spans := []Span{{
+		TraceID:   traceId,
+		SpanID:    rootId,
+		Name:      command,
+		StartTime: startedAt,
+		EndTime:   startedAt.Add(time.Duration(duration) * time.Microsecond),
+		Attributes: map[string]string{
+			"cassandra.session_id": sessionId,
+			"cassandra.query":      command,
+		},
+	}}
+
+	// Group events by (source, thread) preserving arrival order, so we can
+	// derive each event's duration from the next event in its chain.
+	groups := make(map[spanKey][]Event)
+	var order []spanKey
+	for _, e := range events {
+		k := spanKey{e.Source, e.Thread}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], e)
+	}
+
+	ids := make(map[spanKey][]trace.SpanID)
+	parent := make(map[spanKey]trace.SpanID)
+	for _, k := range order {
+		parent[k] = rootId
+	}
+
+	// Any event mentioning another node's host reparents that node's chain
+	// underneath the mentioning event's span, so cross-node forwarding shows
+	// up as a child relationship rather than a second root.
+	reparented := make(map[string]bool)
+	for _, k := range order {
+		chain := groups[k]
+		chainIds := make([]trace.SpanID, len(chain))
+		for i, e := range chain {
+			chainIds[i] = spanId(sessionId, fmt.Sprintf("%s|%s|%d", e.Source, e.Thread, i))
+		}
+		ids[k] = chainIds
+
+		for i, e := range chain {
+			if len(e.Mentions) == 0 || reparented[e.Mentions] {
+				continue
+			}
+			for _, other := range order {
+				if other.source == e.Mentions {
+					parent[other] = chainIds[i]
+					reparented[e.Mentions] = true
+					break
+				}
+			}
+		}
+	}
+
+	for _, k := range order {
+		chain := groups[k]
+		chainIds := ids[k]
+		for i, e := range chain {
+			// Duration comes from the source_elapsed delta to the next event in
+			// this (source, thread) chain, not the dateOf(event_id) timestamp,
+			// which is only millisecond-resolution and collapses fast events.
+			var elapsedMicros int
+			if i+1 < len(chain) {
+				elapsedMicros = chain[i+1].SourceElapsed - e.SourceElapsed
+			} else {
+				elapsedMicros = duration - e.SourceElapsed
+			}
+			if elapsedMicros < 0 {
+				elapsedMicros = 0
+			}
+			end := e.Id.Add(time.Duration(elapsedMicros) * time.Microsecond)
+
+			p := rootId
+			if i == 0 {
+				p = parent[k]
+			} else {
+				p = chainIds[i-1]
+			}
+			spans = append(spans, Span{
+				TraceID:      traceId,
+				SpanID:       chainIds[i],
+				ParentSpanID: p,
+				Name:         e.Activity,
+				Source:       e.Source,
+				StartTime:    e.Id,
+				EndTime:      end,
+				Attributes: map[string]string{
+					"cassandra.source":     e.Source,
+					"cassandra.thread":     e.Thread,
+					"cassandra.session_id": sessionId,
+					"cassandra.query":      command,
+				},
+			})
+		}
+	}
+
+	return spans
+}
+
+func traceIdFromSession(sessionId string) trace.TraceID {
+	var id trace.TraceID
+	h := fnv.New128a()
+	h.Write([]byte(sessionId))
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+func spanId(sessionId, seed string) trace.SpanID {
+	var id trace.SpanID
+	h := fnv.New64a()
+	h.Write([]byte(sessionId))
+	h.Write([]byte("|"))
+	h.Write([]byte(seed))
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// jsonSpan is the NDJSON wire shape written when no --otlp-endpoint is set.
+type jsonSpan struct {
+	TraceId           string            `json:"traceId"`
+	SpanId            string            `json:"spanId"`
+	ParentSpanId      string            `json:"parentSpanId,omitempty"`
+	Name              string            `json:"name"`
+	StartTimeUnixNano int64             `json:"startTimeUnixNano"`
+	EndTimeUnixNano   int64             `json:"endTimeUnixNano"`
+	Attributes        map[string]string `json:"attributes"`
+}
+
+// WriteJSONSpans emits one JSON object per span to stdout, newline-delimited so
+// large trace dumps can stream into jq or another line-oriented consumer.
+func WriteJSONSpans(spans []Span) error {
+	enc := json.NewEncoder(os.Stdout)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceId:           hex.EncodeToString(s.TraceID[:]),
+			SpanId:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			StartTimeUnixNano: s.StartTime.UnixNano(),
+			EndTimeUnixNano:   s.EndTime.UnixNano(),
+			Attributes:        s.Attributes,
+		}
+		if s.ParentSpanID.IsValid() {
+			js.ParentSpanId = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fixedIdGenerator hands out the TraceID/SpanID we already computed in
+// BuildSpans, in the order spans are started, so the SDK's span IDs line up
+// with the parent/child relationships BuildSpans derived from the
+// (source, thread) chains and cross-node mentions.
+type fixedIdGenerator struct {
+	spans []Span
+	next  int
+}
+
+func (g *fixedIdGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	s := g.spans[g.next]
+	g.next++
+	return s.TraceID, s.SpanID
+}
+
+func (g *fixedIdGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	s := g.spans[g.next]
+	g.next++
+	return s.SpanID
+}
+
+// ExportOTLP ships spans to an OTLP collector. Endpoints that look like a
+// Jaeger backend (protocol "jaeger") go over OTLP/HTTP, since modern Jaeger
+// speaks OTLP natively on its HTTP port; everything else uses OTLP/gRPC.
+func ExportOTLP(ctx context.Context, endpoint, protocol string, spans []Span) error {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	if protocol == "jaeger" {
+		exporter, err = otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpoint(endpoint),
+			otlptracehttp.WithInsecure(),
+		)
+	} else {
+		exporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("creating OTLP exporter: %s", err)
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(
+		semconv.ServiceNameKey.String("cassandra-trace-reporting"),
+	))
+	if err != nil {
+		return fmt.Errorf("building OTLP resource: %s", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithIDGenerator(&fixedIdGenerator{spans: spans}),
+	)
+	defer tp.Shutdown(ctx)
+
+	tracer := tp.Tracer("cassandra-trace-reporting")
+	spanCtx := make(map[trace.SpanID]context.Context, len(spans))
+	spanCtx[trace.SpanID{}] = ctx
+
+	for _, s := range spans {
+		parent, ok := spanCtx[s.ParentSpanID]
+		if !ok {
+			parent = ctx
+		}
+
+		attrs := make([]attribute.KeyValue, 0, len(s.Attributes))
+		for k, v := range s.Attributes {
+			attrs = append(attrs, attribute.String(k, v))
+		}
+
+		spanStartCtx, span := tracer.Start(parent, s.Name,
+			trace.WithTimestamp(s.StartTime),
+			trace.WithAttributes(attrs...),
+		)
+		span.End(trace.WithTimestamp(s.EndTime))
+		spanCtx[s.SpanID] = spanStartCtx
+	}
+
+	return nil
+}
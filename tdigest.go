@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// centroid is a single weighted mean in a TDigest.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest is a small, bounded-size t-digest: a quantile sketch that keeps
+// memory bounded by merging nearby centroids instead of retaining every
+// observation, so `stats` can report p50/p95/p99 latency regardless of how
+// many sessions have been scanned.
+type TDigest struct {
+	maxCentroids int
+	delta        float64
+	centroids    []centroid
+	total        float64
+}
+
+// NewTDigest returns a TDigest that compresses once its buffer reaches 100
+// centroids, with delta=0.01. Compression only merges within one unit of
+// k-space, so with this delta the buffer is not held at 100: no merges happen
+// until about 400 observations, and afterwards the count stays bounded at a
+// few hundred centroids, with every Add past 100 triggering a compress.
+func NewTDigest() *TDigest {
+	return &TDigest{maxCentroids: 100, delta: 0.01}
+}
+
+// Add inserts x as a new weight-1 centroid, compressing the buffer first if
+// it's already at capacity.
+func (t *TDigest) Add(x float64) {
+	if len(t.centroids) >= t.maxCentroids {
+		t.compress()
+	}
+	t.centroids = append(t.centroids, centroid{mean: x, weight: 1})
+	t.total++
+}
+
+// scaleK is the t-digest scale function k(q) = delta^-1 * arcsin(2q - 1),
+// which maps a quantile to a uniform "k-space" so that merging centroids
+// near the median is discouraged less than it is in the tails.
+func scaleK(q, delta float64) float64 {
+	x := 2*q - 1
+	if x > 1 {
+		x = 1
+	} else if x < -1 {
+		x = -1
+	}
+	return math.Asin(x) / delta
+}
+
+// compress sorts the centroid buffer and greedily merges adjacent centroids
+// into the preceding one as long as doing so keeps the covered quantile
+// range within one unit of k-space, per the t-digest size bound.
+func (t *TDigest) compress() {
+	if len(t.centroids) == 0 {
+		return
+	}
+
+	sort.Slice(t.centroids, func(i, j int) bool {
+		return t.centroids[i].mean < t.centroids[j].mean
+	})
+
+	merged := make([]centroid, 0, len(t.centroids))
+	cum := 0.0
+	i := 0
+	for i < len(t.centroids) {
+		c := t.centroids[i]
+		qLo := cum / t.total
+		j := i + 1
+		for j < len(t.centroids) {
+			candidateWeight := c.weight + t.centroids[j].weight
+			qHi := (cum + candidateWeight) / t.total
+			if scaleK(qHi, t.delta)-scaleK(qLo, t.delta) > 1 {
+				break
+			}
+			c.mean = (c.mean*c.weight + t.centroids[j].mean*t.centroids[j].weight) / candidateWeight
+			c.weight = candidateWeight
+			j++
+		}
+		cum += c.weight
+		merged = append(merged, c)
+		i = j
+	}
+
+	t.centroids = merged
+}
+
+// Quantile returns an estimate of the q-th quantile (0 <= q <= 1) by walking
+// the sorted centroids and linearly interpolating between the two whose
+// cumulative weight brackets q*total.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	target := q * t.total
+	cum := 0.0
+	for i, c := range t.centroids {
+		if cum+c.weight >= target {
+			if i == 0 {
+				return c.mean
+			}
+			prev := t.centroids[i-1]
+			frac := (target - cum) / c.weight
+			return prev.mean + frac*(c.mean-prev.mean)
+		}
+		cum += c.weight
+	}
+
+	return t.centroids[len(t.centroids)-1].mean
+}
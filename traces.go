@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/fatih/color"
@@ -17,19 +18,39 @@ import (
 )
 
 var (
-	app      = kingpin.New("cassandra-trace-reporting", "Introspect Cassandra query traces.")
-	cqlshrc  = app.Flag("cqlshrc", "Full path to cqlshrc file.").Default("cqlshrc").String()
-	hostname = app.Flag("hostname", "Cassandra host.").Default("localhost").String()
-	port     = app.Flag("port", "Cassanra port.").Default("9042").Int()
+	app        = kingpin.New("cassandra-trace-reporting", "Introspect Cassandra query traces.")
+	cqlshrc    = app.Flag("cqlshrc", "Full path to cqlshrc file.").Default("cqlshrc").String()
+	hostname   = app.Flag("hostname", "Comma-separated list of Cassandra seed hosts.").Default("localhost").String()
+	port       = app.Flag("port", "Cassanra port.").Default("9042").Int()
+	dc         = app.Flag("dc", "Local datacenter name; enables DC-aware routing.").String()
+	tokenAware = app.Flag("token-aware", "Wrap the host selection policy so queries route to the token owner.").Bool()
+	output     = app.Flag("output", "Output format.").Default("table").Enum("table", "json", "csv", "tsv")
 
 	sessions    = app.Command("sessions", "Query trace sessions.")
 	minDuration = sessions.Flag("min-duration", "Minimum query duration (in mircos)").Default("0").Int()
 
-	events     = app.Command("events", "Retrieve events for a trace session.")
-	sessId     = events.Flag("id", "Session ID").Required().String()
-	onlySource = events.Flag("only-source", "Only show events for a specific source.").String()
+	events       = app.Command("events", "Retrieve events for a trace session.")
+	sessId       = events.Flag("id", "Session ID").Required().String()
+	onlySource   = events.Flag("only-source", "Only show events for a specific source.").String()
+	export       = events.Flag("export", "Export the session as spans: otlp, jaeger, or json-spans.").Enum("otlp", "jaeger", "json-spans")
+	otlpEndpoint = events.Flag("otlp-endpoint", "OTLP collector endpoint (host:port) for --export=otlp|jaeger; if unset, spans are written to stdout as NDJSON.").String()
+	hostsFile    = events.Flag("hosts-file", "Optional static ip-to-hostname map (/etc/hosts format), consulted before DNS.").String()
+	dnsCacheTTL  = events.Flag("dns-cache-ttl", "How long to cache reverse-DNS lookups.").Default("5m").Duration()
 
 	statistics = app.Command("stats", "Report query statistics.")
+	since      = statistics.Flag("since", "Only include sessions started after this time (duration ago, e.g. 1h, or an RFC3339 timestamp).").String()
+	until      = statistics.Flag("until", "Only include sessions started before this time (duration ago, e.g. 1h, or an RFC3339 timestamp).").String()
+	groupBy    = statistics.Flag("group-by", "Comma-separated grouping dimensions: query, coordinator.").Default("query").String()
+
+	watch            = app.Command("watch", "Continuously poll for new trace sessions.")
+	watchInterval    = watch.Flag("interval", "Polling interval.").Default("5s").Duration()
+	watchMinDuration = watch.Flag("min-duration", "Minimum query duration (in micros) to report.").Default("0").Int()
+	watchDrill       = watch.Flag("drill", "Also fetch and print events for each new session.").Bool()
+	watchOnlySource  = watch.Flag("only-source", "When --drill is set, only show events for a specific source.").String()
+	watchHostsFile   = watch.Flag("hosts-file", "Optional static ip-to-hostname map (/etc/hosts format), consulted before DNS.").String()
+	watchDnsCacheTTL = watch.Flag("dns-cache-ttl", "How long to cache reverse-DNS lookups.").Default("5m").Duration()
+	alertThreshold   = watch.Flag("alert-threshold", "Exit non-zero (or POST to --webhook) when a session's duration exceeds this threshold, e.g. 50ms.").String()
+	alertWebhook     = watch.Flag("webhook", "URL to POST an alert to when --alert-threshold is exceeded, instead of exiting non-zero.").String()
 
 	// Console colors
 	yellow = color.New(color.FgYellow).SprintFunc()
@@ -45,9 +66,10 @@ type Session struct {
 }
 
 type Cqlshrc struct {
-	Username string
-	Password string
-	Ca       string
+	Username      string
+	Password      string
+	Ca            string
+	ContactPoints []string
 }
 
 func NewCqlshrc(filename string) (*Cqlshrc, error) {
@@ -67,40 +89,92 @@ func NewCqlshrc(filename string) (*Cqlshrc, error) {
 	if cert, ok := config.Get("ssl", "certfile"); ok {
 		result.Ca = cert
 	}
+	if hosts, ok := config.Get("connection", "hostname"); ok {
+		result.ContactPoints = splitList(hosts)
+	}
+	if points, ok := config.Get("connection", "contact_points"); ok {
+		result.ContactPoints = splitList(points)
+	}
 
 	return result, nil
 }
 
-type queryStats struct {
-	min, max, cumulative, count int
+// splitList parses a comma-separated list, trimming whitespace and dropping
+// empty entries.
+func splitList(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); len(h) > 0 {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
 }
 
-func (q *queryStats) update(duration int) {
-	q.cumulative += duration
-	q.count += 1
-	if duration < q.min {
+// QueryStat aggregates session durations grouped by some combination of
+// query and coordinator (see --group-by). Percentiles are sampled with a
+// TDigest rather than computed exactly, so memory stays bounded no matter
+// how long the cluster has been running or how many sessions match.
+//
+// Keyspace was considered as a third grouping dimension, but
+// system_traces.sessions.parameters never carries a "keyspace" key for most
+// query types, so it's deliberately not offered here rather than advertise
+// a column that's always blank.
+type QueryStat struct {
+	Query           string
+	Coordinator     string
+	min, max, count int
+	digest          *TDigest
+}
+
+// statsGroupBy holds the parsed --group-by dimensions for the running
+// `stats` command; QueryStat.Header/Row consult it to know which dimension
+// columns to render.
+var statsGroupBy []string
+
+func newQueryStat(query, coordinator string) *QueryStat {
+	return &QueryStat{Query: query, Coordinator: coordinator, digest: NewTDigest()}
+}
+
+func (q *QueryStat) update(duration int) {
+	if q.count == 0 || duration < q.min {
 		q.min = duration
 	}
 	if duration > q.max {
 		q.max = duration
 	}
+	q.count += 1
+	q.digest.Add(float64(duration))
 }
 
-func (q *queryStats) avg() int {
-	return q.cumulative / q.count
+func (q *QueryStat) percentile(p float64) int {
+	return int(q.digest.Quantile(p))
 }
 
-func CreateSession(hostname string, port int, cqlshrc string) (*gocql.Session, error) {
-	cluster := gocql.NewCluster(hostname)
+func CreateSession(hostname string, port int, cqlshrc string, dc string, tokenAware bool) (*gocql.Session, error) {
+	rc, err := NewCqlshrc(cqlshrc)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := splitList(hostname)
+	if len(hosts) == 1 && hosts[0] == "localhost" && len(rc.ContactPoints) > 0 {
+		hosts = rc.ContactPoints
+	}
+
+	cluster := gocql.NewCluster(hosts...)
 	cluster.Port = port
 	cluster.Keyspace = "system_traces"
 	cluster.Consistency = gocql.One
-	cluster.HostFilter = gocql.WhiteListHostFilter(hostname)
 
-	rc, err := NewCqlshrc(cqlshrc)
-	if err != nil {
-		return nil, err
+	policy := gocql.RoundRobinHostPolicy()
+	if len(dc) > 0 {
+		policy = gocql.DCAwareRoundRobinPolicy(dc)
+	}
+	if tokenAware {
+		policy = gocql.TokenAwareHostPolicy(policy)
 	}
+	cluster.PoolConfig.HostSelectionPolicy = policy
 
 	cluster.Authenticator = gocql.PasswordAuthenticator{
 		Username: rc.Username,
@@ -137,7 +211,7 @@ func main() {
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
 	// sessions
 	case sessions.FullCommand():
-		client, err := CreateSession(*hostname, *port, *cqlshrc)
+		client, err := CreateSession(*hostname, *port, *cqlshrc, *dc, *tokenAware)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -167,87 +241,130 @@ func main() {
 			return sessions[i].Duration > sessions[j].Duration
 		})
 
+		renderer, err := NewRenderer(*output, 0, 3)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := renderer.WriteHeader(Session{}.Header()); err != nil {
+			log.Fatal(err)
+		}
 		for _, s := range sessions {
-			fmt.Printf("%s | %8d | %-33s | %s\n", yellow(s.Id), s.Duration, s.StartedAt, cyan(s.Parameters["query"]))
+			if err := renderer.WriteRow(s.Row()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := renderer.Close(); err != nil {
+			log.Fatal(err)
 		}
 
-		fmt.Println()
-		fmt.Printf("%d matching results (%d total).", len(sessions), count)
-		fmt.Println()
+		if *output == "table" {
+			fmt.Println()
+			fmt.Printf("%d matching results (%d total).", len(sessions), count)
+			fmt.Println()
+		}
 
 	// events
 	case events.FullCommand():
-		client, err := CreateSession(*hostname, *port, *cqlshrc)
+		client, err := CreateSession(*hostname, *port, *cqlshrc, *dc, *tokenAware)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer client.Close()
 
-		// Achtung; This is IPv4-specific!
-		unresolved := regexp.MustCompile(` (?P<IP>/[\d]{1,3}\.[\d]{1,3}\.[\d]{1,3}\.[\d]{1,3})`)
-		lineNo := 1
-
-		var id time.Time
-		var activity string
-		var srcHost net.IP
-		var srcElapsed int
-		var thread string
-
-		iter := client.Query(`SELECT dateOf(event_id),activity,source,source_elapsed,thread FROM system_traces.events WHERE session_id = ?`, *sessId).Iter()
-		for iter.Scan(&id, &activity, &srcHost, &srcElapsed, &thread) {
-			var srcName string
-			// Resolve IPs to hostnames (if possible)
-			if names, err := net.LookupAddr(srcHost.String()); err != nil || len(names) < 1 {
-				srcName = srcHost.String()
-			} else {
-				srcName = names[0]
+		cache, err := BuildResolver(client, *hostsFile, *dnsCacheTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rows, err := FetchEvents(client, *sessId, *onlySource, cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(*export) > 0 {
+			var sess Session
+			if err := client.Query(
+				"SELECT session_id,command,duration,parameters,started_at FROM system_traces.sessions WHERE session_id = ?",
+				*sessId,
+			).Scan(&sess.Id, &sess.Command, &sess.Duration, &sess.Parameters, &sess.StartedAt); err != nil {
+				log.Fatal(err)
 			}
 
-			// Normalize the source
-			srcName = strings.TrimRight(srcName, ".")
+			spans := BuildSpans(*sessId, sess.Command, sess.StartedAt, sess.Duration, rows)
 
-			// Look for unresolved IP address in the activity string and attempt to resolve it
-			if m := matches(unresolved, activity); len(m) > 0 {
-				ip := strings.TrimLeft(m["IP"], "/")
-				// Best-effort
-				if names, err := net.LookupAddr(ip); err == nil || len(names) > 1 {
-					activity = strings.Replace(activity, m["IP"], names[0], -1)
+			switch *export {
+			case "json-spans":
+				if err := WriteJSONSpans(spans); err != nil {
+					log.Fatal(err)
+				}
+			case "otlp", "jaeger":
+				if len(*otlpEndpoint) < 1 {
+					// No collector to ship to: fall back to NDJSON spans on stdout.
+					if err := WriteJSONSpans(spans); err != nil {
+						log.Fatal(err)
+					}
+				} else if err := ExportOTLP(context.Background(), *otlpEndpoint, *export, spans); err != nil {
+					log.Fatal(err)
 				}
 			}
-
-			// (Maybe )filter events to those from a single source name/IP.
-			if len(*onlySource) < 1 || *onlySource == srcName {
-				fmt.Printf("%2d | %-48s | %15s | %8d | %s | %s\n", lineNo, yellow(id), srcName, srcElapsed, thread, cyan(activity))
-				lineNo += 1
+		} else {
+			renderer, err := NewRenderer(*output, 0, 4)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := renderer.WriteHeader(Event{}.Header()); err != nil {
+				log.Fatal(err)
+			}
+			for _, e := range rows {
+				if err := renderer.WriteRow(e.Row()); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if err := renderer.Close(); err != nil {
+				log.Fatal(err)
 			}
-		}
-
-		if err := iter.Close(); err != nil {
-			log.Fatal(err)
 		}
 
 	// statistics
 	case statistics.FullCommand():
-		client, err := CreateSession(*hostname, *port, *cqlshrc)
+		client, err := CreateSession(*hostname, *port, *cqlshrc, *dc, *tokenAware)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer client.Close()
 
-		// a map of query strigs and queryStats structs
-		queries := make(map[string]*queryStats)
+		statsGroupBy = splitList(*groupBy)
+		for _, d := range statsGroupBy {
+			if d != "query" && d != "coordinator" {
+				log.Fatal(fmt.Sprintf("--group-by: unrecognized dimension %q (want query, coordinator)", d))
+			}
+		}
+
+		query, args, err := statsQuery(*since, *until, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// a map of group key to QueryStat
+		queries := make(map[string]*QueryStat)
 
 		var duration int
 		var parameters map[string]string
+		var coordinator net.IP
 		count := 0
 
-		iter := client.Query("SELECT duration,parameters FROM system_traces.sessions").Iter()
-		for iter.Scan(&duration, &parameters) {
-			if v, exists := queries[parameters["query"]]; !exists {
-				queries[parameters["query"]] = &queryStats{duration, duration, duration, 1}
-			} else {
-				v.update(duration)
+		iter := client.Query(query, args...).Iter()
+		for iter.Scan(&duration, &parameters, &coordinator) {
+			q := parameters["query"]
+			c := coordinator.String()
+
+			key := groupKey(statsGroupBy, q, c)
+			v, exists := queries[key]
+			if !exists {
+				v = newQueryStat(q, c)
+				queries[key] = v
 			}
+			v.update(duration)
 			count += 1
 		}
 
@@ -261,18 +378,124 @@ func main() {
 			keys = append(keys, k)
 		}
 
-		// Order our list of keys by the corresponding query avg, descending.
+		// Order our list of keys by the corresponding p99, descending.
 		sort.Slice(keys, func(i, j int) bool {
-			return queries[keys[i]].avg() > queries[keys[j]].avg()
+			return queries[keys[i]].percentile(0.99) > queries[keys[j]].percentile(0.99)
 		})
 
-		fmt.Printf("%9s | %5s | %5s | %5s | %s\n", "Count", "Min", "Max", "Avg", "Query")
+		cyanCol := -1
+		for i, d := range statsGroupBy {
+			if d == "query" {
+				cyanCol = i
+			}
+		}
+		renderer, err := NewRenderer(*output, -1, cyanCol)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := renderer.WriteHeader(QueryStat{}.Header()); err != nil {
+			log.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := renderer.WriteRow(queries[k].Row()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := renderer.Close(); err != nil {
+			log.Fatal(err)
+		}
+
+		if *output == "table" {
+			fmt.Printf("\n%d groups (%d total sessions analyzed).\n", len(queries), count)
+		}
 
-		for k := range keys {
-			s := queries[keys[k]]
-			fmt.Printf("%9d | %5d | %5d | %5d | %s\n", s.count, s.min, s.max, s.avg(), cyan(keys[k]))
+	// watch
+	case watch.FullCommand():
+		client, err := CreateSession(*hostname, *port, *cqlshrc, *dc, *tokenAware)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+
+		var thresholdMicros int
+		if len(*alertThreshold) > 0 {
+			d, err := time.ParseDuration(*alertThreshold)
+			if err != nil {
+				log.Fatal(err)
+			}
+			thresholdMicros = int(d.Microseconds())
 		}
 
-		fmt.Printf("\n%d unique queries (%d total sessions analyzed).\n", len(queries), count)
+		cache, err := BuildResolver(client, *watchHostsFile, *watchDnsCacheTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := Watch(client, *watchInterval, *watchMinDuration, thresholdMicros, *watchDrill, *alertWebhook, *watchOnlySource, *output, cache); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// groupKey builds the map key for a row given the requested --group-by
+// dimensions, so rows that differ only in a dimension we're not grouping by
+// still aggregate together.
+func groupKey(dims []string, query, coordinator string) string {
+	var parts []string
+	for _, d := range dims {
+		switch d {
+		case "query":
+			parts = append(parts, query)
+		case "coordinator":
+			parts = append(parts, coordinator)
+		}
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+// statsQuery builds the system_traces.sessions SELECT for the `stats`
+// command, pushing --since/--until down as started_at predicates. Cassandra
+// requires ALLOW FILTERING here since started_at isn't part of the
+// partition key.
+func statsQuery(since, until string, now time.Time) (string, []interface{}, error) {
+	q := "SELECT duration,parameters,coordinator FROM system_traces.sessions"
+
+	var conditions []string
+	var args []interface{}
+
+	if len(since) > 0 {
+		t, err := parseTimeBound(since, now)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, "started_at >= ?")
+		args = append(args, t)
+	}
+	if len(until) > 0 {
+		t, err := parseTimeBound(until, now)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, "started_at <= ?")
+		args = append(args, t)
+	}
+
+	if len(conditions) > 0 {
+		q += " WHERE " + strings.Join(conditions, " AND ") + " ALLOW FILTERING"
+	}
+
+	return q, args, nil
+}
+
+// parseTimeBound parses a --since/--until value as either a duration
+// relative to now (e.g. "1h" meaning "1 hour ago") or an absolute RFC3339
+// timestamp.
+func parseTimeBound(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
 	}
+	return time.Time{}, errors.New("invalid time bound " + s + ": must be a duration (e.g. 1h) or an RFC3339 timestamp")
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Watch polls system_traces.sessions every interval, remembering the
+// highest started_at seen so far, and renders only sessions newer than that
+// high-water mark whose duration is at least minDuration. The first poll
+// only establishes the high-water mark; it doesn't replay history.
+//
+// When drill is set, it also fetches and renders that session's events. When
+// alertThreshold is positive, a session exceeding it either POSTs to webhook
+// (if set) or causes Watch to exit non-zero, so it can be wired into cron or
+// a systemd timer without a separate monitoring stack.
+func Watch(client *gocql.Session, interval time.Duration, minDuration, alertThreshold int, drill bool, webhook, onlySource, output string, cache *dnsCache) error {
+	sessionsRenderer, err := NewRenderer(output, 0, 3)
+	if err != nil {
+		return err
+	}
+	if err := sessionsRenderer.WriteHeader(Session{}.Header()); err != nil {
+		return err
+	}
+
+	highWater := time.Time{}
+	first := true
+
+	for {
+		var id gocql.UUID
+		var cmd string
+		var duration int
+		var parameters map[string]string
+		var started time.Time
+
+		var fresh []Session
+		newHighWater := highWater
+
+		iter := client.Query("SELECT session_id,command,duration,parameters,started_at FROM system_traces.sessions").Iter()
+		for iter.Scan(&id, &cmd, &duration, &parameters, &started) {
+			if started.After(newHighWater) {
+				newHighWater = started
+			}
+			if started.After(highWater) && duration >= minDuration {
+				fresh = append(fresh, Session{id, cmd, duration, parameters, started})
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		sort.Slice(fresh, func(i, j int) bool {
+			return fresh[i].StartedAt.Before(fresh[j].StartedAt)
+		})
+
+		if !first {
+			for _, s := range fresh {
+				if err := sessionsRenderer.WriteRow(s.Row()); err != nil {
+					return err
+				}
+
+				// Flush this session's row before any drilled events so
+				// buffered outputs (table, csv/tsv) print "session, then its
+				// events" instead of every drill block up front.
+				if err := sessionsRenderer.Close(); err != nil {
+					return err
+				}
+
+				if drill {
+					events, err := FetchEvents(client, s.Id.String(), onlySource, cache)
+					if err != nil {
+						log.Printf("warning: could not fetch events for session %s: %s", s.Id, err)
+					} else {
+						eventsRenderer, err := NewRenderer(output, 0, 4)
+						if err != nil {
+							return err
+						}
+						eventsRenderer.WriteHeader(Event{}.Header())
+						for _, e := range events {
+							eventsRenderer.WriteRow(e.Row())
+						}
+						eventsRenderer.Close()
+					}
+				}
+
+				if alertThreshold > 0 && s.Duration > alertThreshold {
+					if err := alert(s, webhook); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		highWater = newHighWater
+		first = false
+
+		time.Sleep(interval)
+	}
+}
+
+// alert reports a session that exceeded --alert-threshold: POST it to
+// webhook if one is configured, otherwise return an error so the caller can
+// exit non-zero (the expected signal for cron/systemd-timer alerting).
+func alert(s Session, webhook string) error {
+	if len(webhook) == 0 {
+		return fmt.Errorf("session %s exceeded alert threshold: %dµs (%s)", s.Id, s.Duration, s.Parameters["query"])
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"session_id": s.Id.String(),
+		"duration":   s.Duration,
+		"started_at": s.StartedAt,
+		"query":      s.Parameters["query"],
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("posting alert to webhook: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}